@@ -1,12 +1,21 @@
 package log
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fsouza/go-dockerclient"
@@ -17,19 +26,104 @@ import (
 	"gopkg.in/mcuadros/go-syslog.v2"
 )
 
+const (
+	dockerEventsRetryInterval = 5 * time.Second
+	forwardQueueSize          = 1000
+	forwardReconnectMinDelay  = 500 * time.Millisecond
+	forwardReconnectMaxDelay  = 30 * time.Second
+	dropLogInterval           = 5 * time.Second
+	defaultShutdownTimeout    = 5 * time.Second
+)
+
 type LogForwarder struct {
 	BindAddress        string
 	ForwardAddresses   []string
 	DockerEndpoint     string
+	DockerTLSCert      string
+	DockerTLSKey       string
+	DockerTLSCA        string
+	ForwardTLSCert     string
+	ForwardTLSKey      string
+	ForwardTLSCA       string
 	AppNameEnvVar      string
 	ProcessNameEnvVar  string
+	AppNameLabel       string
+	ProcessNameLabel   string
 	TsuruEndpoint      string
 	TsuruToken         string
+	ShutdownTimeout    time.Duration
 	server             *syslog.Server
-	forwardConns       []net.Conn
+	forwardConns       []*forwardConn
+	dockerClient       *docker.Client
 	containerDataCache *lru.Cache
+	wsMu               sync.Mutex
 	wsConn             *websocket.Conn
 	wsJsonEncoder      *json.Encoder
+	wsQueue            chan app.Applog
+	wsDone             chan struct{}
+	wsDropped          int64
+	wsLastDropLog      int64
+	stopEvents         chan struct{}
+	writersWG          sync.WaitGroup
+	shutdownOnce       sync.Once
+}
+
+// forwardConn is a single forward destination: a buffered queue plus the
+// writer goroutine that owns the underlying connection and reconnects it on
+// write failures, so a slow or dead endpoint never blocks the syslog handler.
+// conn is guarded by connMu since the writer goroutine reads/reassigns it
+// while shutdown forcibly closes it from another goroutine to unblock a
+// stuck write.
+type forwardConn struct {
+	addr        string
+	network     string
+	host        string
+	path        string
+	tlsConfig   *tls.Config
+	connMu      sync.Mutex
+	conn        net.Conn
+	queue       chan []byte
+	done        chan struct{}
+	dropped     int64
+	lastDropLog int64
+}
+
+// dial (re)connects fc, honoring the unix socket path or TLS config derived
+// from its address scheme.
+func (fc *forwardConn) dial() (net.Conn, error) {
+	if fc.tlsConfig != nil {
+		return tls.Dial(fc.network, fc.host, fc.tlsConfig)
+	}
+	if fc.network == "unix" {
+		return net.Dial("unix", fc.path)
+	}
+	return net.Dial(fc.network, fc.host)
+}
+
+func (fc *forwardConn) setConn(conn net.Conn) {
+	fc.connMu.Lock()
+	fc.conn = conn
+	fc.connMu.Unlock()
+}
+
+func (fc *forwardConn) getConn() net.Conn {
+	fc.connMu.Lock()
+	defer fc.connMu.Unlock()
+	return fc.conn
+}
+
+// closeConn closes and clears fc.conn, if any. It is safe to call
+// concurrently with the writer goroutine's own use of fc.conn: the writer
+// only ever holds a local copy obtained through getConn/setConn, so closing
+// the connection here just unblocks whatever read/write it is stuck on.
+func (fc *forwardConn) closeConn() {
+	fc.connMu.Lock()
+	conn := fc.conn
+	fc.conn = nil
+	fc.connMu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
 }
 
 type containerData struct {
@@ -38,21 +132,166 @@ type containerData struct {
 }
 
 func (l *LogForwarder) initForwardConnections() error {
-	l.forwardConns = make([]net.Conn, len(l.ForwardAddresses))
+	l.forwardConns = make([]*forwardConn, len(l.ForwardAddresses))
 	for i, addr := range l.ForwardAddresses {
-		forwardUrl, err := url.Parse(addr)
+		fc, err := l.newForwardConn(addr)
 		if err != nil {
-			return fmt.Errorf("unable to parse %q: %s", addr, err)
+			return err
 		}
-		conn, err := net.Dial(forwardUrl.Scheme, forwardUrl.Host)
+		conn, err := fc.dial()
 		if err != nil {
 			return fmt.Errorf("unable to connect to %q: %s", addr, err)
 		}
-		l.forwardConns[i] = conn
+		fc.setConn(conn)
+		fc.queue = make(chan []byte, forwardQueueSize)
+		fc.done = make(chan struct{})
+		l.forwardConns[i] = fc
+		l.writersWG.Add(1)
+		go l.runForwardWriter(fc)
 	}
 	return nil
 }
 
+// newForwardConn parses addr and resolves it to the network/host/path (and,
+// for tls:// and tcp+tls://, the TLS config) dial() will use. unix:// is
+// also accepted, for forwarding to a local journald/rsyslog imuxsock.
+func (l *LogForwarder) newForwardConn(addr string) (*forwardConn, error) {
+	forwardUrl, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %q: %s", addr, err)
+	}
+	fc := &forwardConn{addr: addr}
+	switch forwardUrl.Scheme {
+	case "unix":
+		fc.network = "unix"
+		fc.path = forwardUrl.Path
+	case "tls", "tcp+tls":
+		fc.network = "tcp"
+		fc.host = forwardUrl.Host
+		fc.tlsConfig, err = buildTLSConfig(l.ForwardTLSCert, l.ForwardTLSKey, l.ForwardTLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("unable to build TLS config for %q: %s", addr, err)
+		}
+	default:
+		fc.network = forwardUrl.Scheme
+		fc.host = forwardUrl.Host
+	}
+	return fc, nil
+}
+
+// buildTLSConfig loads an optional client certificate/key pair and CA
+// bundle, returning nil values for anything left unconfigured.
+func buildTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("unable to parse CA certificate %q", caFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// runForwardWriter drains fc's queue and writes each message to its
+// connection, reconnecting with exponential backoff on failure. It exits
+// once fc.queue is closed and drained or fc.done is closed.
+func (l *LogForwarder) runForwardWriter(fc *forwardConn) {
+	defer l.writersWG.Done()
+	for {
+		select {
+		case <-fc.done:
+			return
+		case msg, ok := <-fc.queue:
+			if !ok {
+				return
+			}
+			l.writeForward(fc, msg)
+		}
+	}
+}
+
+func (l *LogForwarder) writeForward(fc *forwardConn, msg []byte) {
+	for {
+		if conn := fc.getConn(); conn != nil {
+			n, err := conn.Write(msg)
+			if err == nil && n == len(msg) {
+				return
+			}
+			if err != nil {
+				log.Printf("[log forwarder] error trying to write log to %q: %s", fc.addr, err)
+			} else {
+				log.Printf("[log forwarder] short write trying to write log to %q", fc.addr)
+				return
+			}
+		}
+		if !l.reconnectForward(fc) {
+			return
+		}
+	}
+}
+
+// reconnectForward redials fc's address with exponential backoff (capped at
+// forwardReconnectMaxDelay, with jitter to avoid reconnect storms) until it
+// succeeds or fc.done is closed, in which case it returns false.
+func (l *LogForwarder) reconnectForward(fc *forwardConn) bool {
+	fc.closeConn()
+	delay := forwardReconnectMinDelay
+	for {
+		select {
+		case <-fc.done:
+			return false
+		default:
+		}
+		conn, err := fc.dial()
+		if err == nil {
+			fc.setConn(conn)
+			return true
+		}
+		wait := jitter(delay)
+		log.Printf("[log forwarder] unable to reconnect to %q: %s, retrying in %s", fc.addr, err, wait)
+		select {
+		case <-fc.done:
+			return false
+		case <-time.After(wait):
+		}
+		delay *= 2
+		if delay > forwardReconnectMaxDelay {
+			delay = forwardReconnectMaxDelay
+		}
+	}
+}
+
+// jitter returns a random duration in [delay/2, delay), so concurrent
+// writers backing off against the same endpoint don't all retry in lockstep.
+func jitter(delay time.Duration) time.Duration {
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
+
+func (fc *forwardConn) recordDrop() {
+	n := atomic.AddInt64(&fc.dropped, 1)
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&fc.lastDropLog)
+	if now-last > int64(dropLogInterval) && atomic.CompareAndSwapInt64(&fc.lastDropLog, last, now) {
+		log.Printf("[log forwarder] forward queue to %q is full, dropped %d messages so far", fc.addr, n)
+	}
+}
+
 func (l *LogForwarder) initWSConnection() error {
 	if l.TsuruEndpoint == "" {
 		return nil
@@ -62,11 +301,130 @@ func (l *LogForwarder) initWSConnection() error {
 		return err
 	}
 	wsUrl := fmt.Sprintf("ws://%s/logs", tsuruUrl.Host)
-	l.wsConn, err = websocket.Dial(wsUrl, "", "ws://localhost/")
+	conn, err := websocket.Dial(wsUrl, "", "ws://localhost/")
 	if err != nil {
 		return err
 	}
-	l.wsJsonEncoder = json.NewEncoder(l.wsConn)
+	l.setWSConn(conn, json.NewEncoder(conn))
+	return nil
+}
+
+func (l *LogForwarder) setWSConn(conn *websocket.Conn, enc *json.Encoder) {
+	l.wsMu.Lock()
+	l.wsConn = conn
+	l.wsJsonEncoder = enc
+	l.wsMu.Unlock()
+}
+
+func (l *LogForwarder) getWSEncoder() *json.Encoder {
+	l.wsMu.Lock()
+	defer l.wsMu.Unlock()
+	return l.wsJsonEncoder
+}
+
+// closeWSConn closes and clears the websocket connection, if any. Safe to
+// call concurrently with the ws writer goroutine's own use of the
+// connection, which only ever holds a local copy obtained through
+// getWSEncoder/setWSConn.
+func (l *LogForwarder) closeWSConn() {
+	l.wsMu.Lock()
+	conn := l.wsConn
+	l.wsConn = nil
+	l.wsJsonEncoder = nil
+	l.wsMu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// startWSWriter drains wsQueue in its own goroutine so a stalled tsuru API
+// does not block the syslog handler.
+func (l *LogForwarder) startWSWriter() {
+	if l.TsuruEndpoint == "" {
+		return
+	}
+	l.wsQueue = make(chan app.Applog, forwardQueueSize)
+	l.wsDone = make(chan struct{})
+	l.writersWG.Add(1)
+	go l.runWSWriter()
+}
+
+func (l *LogForwarder) runWSWriter() {
+	defer l.writersWG.Done()
+	for {
+		select {
+		case <-l.wsDone:
+			return
+		case msg, ok := <-l.wsQueue:
+			if !ok {
+				return
+			}
+			l.writeWS(msg)
+		}
+	}
+}
+
+func (l *LogForwarder) writeWS(msg app.Applog) {
+	for retries := 2; retries > 0; retries-- {
+		enc := l.getWSEncoder()
+		if enc == nil {
+			return
+		}
+		err := enc.Encode(msg)
+		if err == nil {
+			return
+		}
+		log.Printf("[log forwarder] error encoding message: %s", err)
+		l.initWSConnection()
+	}
+}
+
+func (l *LogForwarder) recordWSDrop() {
+	n := atomic.AddInt64(&l.wsDropped, 1)
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&l.wsLastDropLog)
+	if now-last > int64(dropLogInterval) && atomic.CompareAndSwapInt64(&l.wsLastDropLog, last, now) {
+		log.Printf("[log forwarder] ws queue is full, dropped %d messages so far", n)
+	}
+}
+
+// applyDockerEnvDefaults fills in DockerEndpoint and the TLS cert paths from
+// the same environment variables the docker CLI honors, so bs can be
+// configured the same way as the daemon it is talking to.
+func (l *LogForwarder) applyDockerEnvDefaults() {
+	if l.DockerEndpoint == "" {
+		l.DockerEndpoint = os.Getenv("DOCKER_HOST")
+	}
+	certPath := os.Getenv("DOCKER_CERT_PATH")
+	if certPath == "" || os.Getenv("DOCKER_TLS_VERIFY") == "" {
+		return
+	}
+	if l.DockerTLSCert == "" {
+		l.DockerTLSCert = filepath.Join(certPath, "cert.pem")
+	}
+	if l.DockerTLSKey == "" {
+		l.DockerTLSKey = filepath.Join(certPath, "key.pem")
+	}
+	if l.DockerTLSCA == "" {
+		l.DockerTLSCA = filepath.Join(certPath, "ca.pem")
+	}
+}
+
+func (l *LogForwarder) initDockerClient() error {
+	l.applyDockerEnvDefaults()
+	if l.DockerTLSCert != "" || l.DockerTLSKey != "" || l.DockerTLSCA != "" {
+		client, err := docker.NewTLSClient(l.DockerEndpoint, l.DockerTLSCert, l.DockerTLSKey, l.DockerTLSCA)
+		if err != nil {
+			return err
+		}
+		l.dockerClient = client
+		return nil
+	}
+	client, err := docker.NewClient(l.DockerEndpoint)
+	if err != nil {
+		return err
+	}
+	l.dockerClient = client
 	return nil
 }
 
@@ -75,14 +433,24 @@ func (l *LogForwarder) Start() error {
 	if err != nil {
 		return err
 	}
+	l.startWSWriter()
 	err = l.initForwardConnections()
 	if err != nil {
 		return err
 	}
+	err = l.initDockerClient()
+	if err != nil {
+		return err
+	}
 	l.containerDataCache, err = lru.New(100)
 	if err != nil {
 		return err
 	}
+	l.stopEvents = make(chan struct{})
+	if err = l.populateInitialContainers(); err != nil {
+		log.Printf("[log forwarder] unable to list running containers: %s", err)
+	}
+	go l.watchDockerEvents()
 	l.server = syslog.NewServer()
 	l.server.SetHandler(l)
 	l.server.SetFormat(LenientFormat{})
@@ -103,35 +471,167 @@ func (l *LogForwarder) Start() error {
 	return l.server.Boot()
 }
 
+// stop runs Shutdown with a deadline of ShutdownTimeout (or
+// defaultShutdownTimeout), so buffered messages get that long to drain
+// before the sockets are closed. Prefer Shutdown when a caller-controlled
+// deadline is available.
 func (l *LogForwarder) stop() {
-	func() {
-		defer func() {
-			recover()
+	timeout := l.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	l.Shutdown(ctx)
+}
+
+// Shutdown stops accepting new syslog messages, waits for the forward and
+// websocket writer queues to drain (bounded by ctx) and only then closes
+// the underlying sockets. It returns ctx.Err() if the deadline was reached
+// before the writers finished draining. Shutdown is safe to call more than
+// once (e.g. from both a signal trap and stop()); only the first call runs
+// the sequence below, later calls are no-ops returning nil.
+func (l *LogForwarder) Shutdown(ctx context.Context) error {
+	var err error
+	l.shutdownOnce.Do(func() {
+		if l.stopEvents != nil {
+			close(l.stopEvents)
+		}
+		func() {
+			defer func() {
+				recover()
+			}()
+			l.server.Kill()
 		}()
-		l.server.Kill()
+		l.server.Wait()
+		l.drainWriters(ctx)
+		l.closeWSConn()
+		err = ctx.Err()
+	})
+	return err
+}
+
+// drainWriters closes every forward and ws queue, giving the writer
+// goroutines until ctx is done to flush whatever was already buffered
+// before their connections are forced closed.
+func (l *LogForwarder) drainWriters(ctx context.Context) {
+	for _, fc := range l.forwardConns {
+		close(fc.queue)
+	}
+	if l.wsQueue != nil {
+		close(l.wsQueue)
+	}
+	drained := make(chan struct{})
+	go func() {
+		l.writersWG.Wait()
+		close(drained)
 	}()
-	l.server.Wait()
-	if l.wsConn != nil {
-		l.wsConn.Close()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		log.Printf("[log forwarder] %s waiting for forward queues to drain", ctx.Err())
+	}
+	for _, fc := range l.forwardConns {
+		close(fc.done)
+		fc.closeConn()
 	}
-	for _, c := range l.forwardConns {
-		c.Close()
+	if l.wsDone != nil {
+		close(l.wsDone)
 	}
 }
 
-func (l *LogForwarder) getContainerData(containerId string) (*containerData, error) {
-	if val, ok := l.containerDataCache.Get(containerId); ok {
-		return val.(*containerData), nil
+// populateInitialContainers lists every currently running container and
+// eagerly primes containerDataCache, so the first log lines received right
+// after Start() don't need a synchronous inspect.
+func (l *LogForwarder) populateInitialContainers() error {
+	containers, err := l.dockerClient.ListContainers(docker.ListContainersOptions{})
+	if err != nil {
+		return err
 	}
-	client, err := docker.NewClient(l.DockerEndpoint)
+	for _, c := range containers {
+		if _, err := l.inspectAndCache(c.ID); err != nil {
+			log.Printf("[log forwarder] unable to inspect container %s during startup scan: %s", c.ID, err)
+		}
+	}
+	return nil
+}
+
+// watchDockerEvents keeps a docker events subscription open for the lifetime
+// of the forwarder, reconnecting with a fixed backoff whenever the stream
+// drops, so containerDataCache stays in sync without polling the daemon.
+func (l *LogForwarder) watchDockerEvents() {
+	for {
+		select {
+		case <-l.stopEvents:
+			return
+		default:
+		}
+		listener := make(chan *docker.APIEvents, 100)
+		err := l.dockerClient.AddEventListener(listener)
+		if err != nil {
+			log.Printf("[log forwarder] unable to subscribe to docker events: %s", err)
+			l.waitRetry()
+			continue
+		}
+		l.consumeDockerEvents(listener)
+		l.dockerClient.RemoveEventListener(listener)
+		if !l.waitRetry() {
+			return
+		}
+	}
+}
+
+// waitRetry blocks for dockerEventsRetryInterval or until the forwarder is
+// stopped, returning false in the latter case.
+func (l *LogForwarder) waitRetry() bool {
+	select {
+	case <-l.stopEvents:
+		return false
+	case <-time.After(dockerEventsRetryInterval):
+		return true
+	}
+}
+
+func (l *LogForwarder) consumeDockerEvents(listener chan *docker.APIEvents) {
+	for {
+		select {
+		case <-l.stopEvents:
+			return
+		case event, ok := <-listener:
+			if !ok {
+				return
+			}
+			switch event.Status {
+			case "start":
+				if _, err := l.inspectAndCache(event.ID); err != nil {
+					log.Printf("[log forwarder] unable to inspect started container %s: %s", event.ID, err)
+				}
+			case "die", "destroy":
+				l.containerDataCache.Remove(event.ID)
+			}
+		}
+	}
+}
+
+func (l *LogForwarder) inspectAndCache(containerId string) (*containerData, error) {
+	cont, err := l.dockerClient.InspectContainer(containerId)
 	if err != nil {
 		return nil, err
 	}
-	cont, err := client.InspectContainer(containerId)
+	data, err := l.extractContainerData(cont)
 	if err != nil {
 		return nil, err
 	}
-	var app, process string
+	l.containerDataCache.Add(containerId, data)
+	return data, nil
+}
+
+// extractContainerData reads app and process identification from the
+// container's labels, preferring them over the legacy environment variables
+// since labels don't require leaking the metadata into the process itself.
+func (l *LogForwarder) extractContainerData(cont *docker.Container) (*containerData, error) {
+	app := labelValue(cont.Config.Labels, l.AppNameLabel)
+	process := labelValue(cont.Config.Labels, l.ProcessNameLabel)
 	for _, val := range cont.Config.Env {
 		if app == "" && strings.HasPrefix(val, l.AppNameEnvVar) {
 			app = val[len(l.AppNameEnvVar):]
@@ -140,12 +640,34 @@ func (l *LogForwarder) getContainerData(containerId string) (*containerData, err
 			process = val[len(l.ProcessNameEnvVar):]
 		}
 		if app != "" && process != "" {
-			data := containerData{appName: app, processName: process}
-			l.containerDataCache.Add(containerId, &data)
-			return &data, nil
+			break
 		}
 	}
-	return nil, fmt.Errorf("could not find app name env in %s", containerId)
+	if app == "" || process == "" {
+		return nil, fmt.Errorf("could not find app or process name label or env in %s", cont.ID)
+	}
+	return &containerData{appName: app, processName: process}, nil
+}
+
+// labelValue returns the value of the label under key. Unlike env vars,
+// where "TSURU_APPNAME=foo" is a single string and needs prefix-stripping,
+// docker labels are already split into key/value, so this is a direct
+// lookup rather than a prefix match.
+func labelValue(labels map[string]string, key string) string {
+	if key == "" {
+		return ""
+	}
+	return labels[key]
+}
+
+// getContainerData looks up the container metadata cache, which is kept
+// warm by watchDockerEvents. It only falls back to a synchronous inspect
+// when the event listener hasn't caught up with a brand new container yet.
+func (l *LogForwarder) getContainerData(containerId string) (*containerData, error) {
+	if val, ok := l.containerDataCache.Get(containerId); ok {
+		return val.(*containerData), nil
+	}
+	return l.inspectAndCache(containerId)
 }
 
 func (l *LogForwarder) Handle(logParts syslogparser.LogParts, msgLen int64, err error) {
@@ -180,24 +702,18 @@ func (l *LogForwarder) Handle(logParts syslogparser.LogParts, msgLen int64, err
 		Source:  contData.processName,
 		Unit:    contId,
 	}
-	for retries := 2; l.wsJsonEncoder != nil && retries > 0; retries-- {
-		err = l.wsJsonEncoder.Encode(tsrMessage)
-		if err == nil {
-			break
+	if l.wsQueue != nil {
+		select {
+		case l.wsQueue <- tsrMessage:
+		default:
+			l.recordWSDrop()
 		}
-		log.Printf("[log forwarder] error encoding message: %s", err)
-		l.initWSConnection()
 	}
-	for _, c := range l.forwardConns {
-		// TODO(cezarsa): One goroutine for each conn, only put to channel here
-		go func(c net.Conn) {
-			n, err := c.Write(msg)
-			if err != nil {
-				log.Printf("[log forwarder] error trying to write log to %q: %s", c.RemoteAddr(), err)
-			}
-			if n < len(msg) {
-				log.Printf("[log forwarder] short write trying to write log to %q", c.RemoteAddr())
-			}
-		}(c)
+	for _, fc := range l.forwardConns {
+		select {
+		case fc.queue <- msg:
+		default:
+			fc.recordDrop()
+		}
 	}
-}
\ No newline at end of file
+}
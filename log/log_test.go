@@ -0,0 +1,456 @@
+// Copyright 2015 bs authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	dtesting "github.com/fsouza/go-dockerclient/testing"
+	"github.com/hashicorp/golang-lru"
+	"github.com/jeromer/syslogparser"
+	"gopkg.in/check.v1"
+	"gopkg.in/mcuadros/go-syslog.v2"
+)
+
+func Test(t *testing.T) {
+	check.TestingT(t)
+}
+
+var _ = check.Suite(S{})
+
+type S struct{}
+
+func (S) forwarder() *LogForwarder {
+	return &LogForwarder{
+		AppNameEnvVar:     "TSURU_APPNAME=",
+		ProcessNameEnvVar: "TSURU_PROCESSNAME=",
+		AppNameLabel:      "tsuru.appname",
+		ProcessNameLabel:  "tsuru.processname",
+	}
+}
+
+func (s S) TestExtractContainerDataLabelOnly(c *check.C) {
+	l := s.forwarder()
+	cont := &docker.Container{
+		ID: "cont-labels",
+		Config: &docker.Config{
+			Labels: map[string]string{
+				"tsuru.appname":     "myapp",
+				"tsuru.processname": "web",
+			},
+		},
+	}
+	data, err := l.extractContainerData(cont)
+	c.Assert(err, check.IsNil)
+	c.Assert(data.appName, check.Equals, "myapp")
+	c.Assert(data.processName, check.Equals, "web")
+}
+
+func (s S) TestExtractContainerDataEnvOnly(c *check.C) {
+	l := s.forwarder()
+	cont := &docker.Container{
+		ID: "cont-env",
+		Config: &docker.Config{
+			Env: []string{"HOME=/", "TSURU_APPNAME=myapp", "TSURU_PROCESSNAME=web"},
+		},
+	}
+	data, err := l.extractContainerData(cont)
+	c.Assert(err, check.IsNil)
+	c.Assert(data.appName, check.Equals, "myapp")
+	c.Assert(data.processName, check.Equals, "web")
+}
+
+func (s S) TestExtractContainerDataMixed(c *check.C) {
+	l := s.forwarder()
+	cont := &docker.Container{
+		ID: "cont-mixed",
+		Config: &docker.Config{
+			Labels: map[string]string{
+				"tsuru.appname": "myapp",
+			},
+			Env: []string{"TSURU_PROCESSNAME=web"},
+		},
+	}
+	data, err := l.extractContainerData(cont)
+	c.Assert(err, check.IsNil)
+	c.Assert(data.appName, check.Equals, "myapp")
+	c.Assert(data.processName, check.Equals, "web")
+}
+
+func (s S) TestExtractContainerDataLabelTakesPrecedenceOverEnv(c *check.C) {
+	l := s.forwarder()
+	cont := &docker.Container{
+		ID: "cont-precedence",
+		Config: &docker.Config{
+			Labels: map[string]string{
+				"tsuru.appname": "fromlabel",
+			},
+			Env: []string{"TSURU_APPNAME=fromenv", "TSURU_PROCESSNAME=web"},
+		},
+	}
+	data, err := l.extractContainerData(cont)
+	c.Assert(err, check.IsNil)
+	c.Assert(data.appName, check.Equals, "fromlabel")
+	c.Assert(data.processName, check.Equals, "web")
+}
+
+func (s S) TestExtractContainerDataMissing(c *check.C) {
+	l := s.forwarder()
+	cont := &docker.Container{
+		ID:     "cont-missing",
+		Config: &docker.Config{},
+	}
+	_, err := l.extractContainerData(cont)
+	c.Assert(err, check.NotNil)
+}
+
+func (s S) TestNewForwardConnTCP(c *check.C) {
+	l := &LogForwarder{}
+	fc, err := l.newForwardConn("tcp://logs.example.com:514")
+	c.Assert(err, check.IsNil)
+	c.Assert(fc.network, check.Equals, "tcp")
+	c.Assert(fc.host, check.Equals, "logs.example.com:514")
+	c.Assert(fc.path, check.Equals, "")
+	c.Assert(fc.tlsConfig, check.IsNil)
+}
+
+func (s S) TestNewForwardConnUDP(c *check.C) {
+	l := &LogForwarder{}
+	fc, err := l.newForwardConn("udp://logs.example.com:514")
+	c.Assert(err, check.IsNil)
+	c.Assert(fc.network, check.Equals, "udp")
+	c.Assert(fc.host, check.Equals, "logs.example.com:514")
+	c.Assert(fc.tlsConfig, check.IsNil)
+}
+
+func (s S) TestNewForwardConnUnix(c *check.C) {
+	l := &LogForwarder{}
+	fc, err := l.newForwardConn("unix:///var/run/rsyslog.sock")
+	c.Assert(err, check.IsNil)
+	c.Assert(fc.network, check.Equals, "unix")
+	c.Assert(fc.path, check.Equals, "/var/run/rsyslog.sock")
+	c.Assert(fc.host, check.Equals, "")
+	c.Assert(fc.tlsConfig, check.IsNil)
+}
+
+func (s S) TestNewForwardConnTLSWithoutCerts(c *check.C) {
+	l := &LogForwarder{}
+	fc, err := l.newForwardConn("tls://logs.example.com:6514")
+	c.Assert(err, check.IsNil)
+	c.Assert(fc.network, check.Equals, "tcp")
+	c.Assert(fc.host, check.Equals, "logs.example.com:6514")
+	c.Assert(fc.tlsConfig, check.NotNil)
+	c.Assert(fc.tlsConfig.Certificates, check.HasLen, 0)
+	c.Assert(fc.tlsConfig.RootCAs, check.IsNil)
+}
+
+func (s S) TestNewForwardConnTCPTLSScheme(c *check.C) {
+	l := &LogForwarder{}
+	fc, err := l.newForwardConn("tcp+tls://logs.example.com:6514")
+	c.Assert(err, check.IsNil)
+	c.Assert(fc.network, check.Equals, "tcp")
+	c.Assert(fc.host, check.Equals, "logs.example.com:6514")
+	c.Assert(fc.tlsConfig, check.NotNil)
+}
+
+func (s S) TestNewForwardConnTLSWithCerts(c *check.C) {
+	dir := c.MkDir()
+	certFile, keyFile, caFile := s.writeTestCertFiles(c, dir)
+	l := &LogForwarder{ForwardTLSCert: certFile, ForwardTLSKey: keyFile, ForwardTLSCA: caFile}
+	fc, err := l.newForwardConn("tls://logs.example.com:6514")
+	c.Assert(err, check.IsNil)
+	c.Assert(fc.tlsConfig.Certificates, check.HasLen, 1)
+	c.Assert(fc.tlsConfig.RootCAs, check.NotNil)
+}
+
+func (s S) TestNewForwardConnInvalidURL(c *check.C) {
+	l := &LogForwarder{}
+	_, err := l.newForwardConn("://bad-url")
+	c.Assert(err, check.NotNil)
+}
+
+func (s S) TestNewForwardConnTLSBadCertFile(c *check.C) {
+	l := &LogForwarder{ForwardTLSCert: "/does/not/exist.pem", ForwardTLSKey: "/does/not/exist-key.pem"}
+	_, err := l.newForwardConn("tls://logs.example.com:6514")
+	c.Assert(err, check.NotNil)
+}
+
+func (s S) TestBuildTLSConfigBadCAFile(c *check.C) {
+	_, err := buildTLSConfig("", "", "/does/not/exist-ca.pem")
+	c.Assert(err, check.NotNil)
+}
+
+// writeTestCertFiles generates a throwaway self-signed certificate and
+// writes its cert, key and CA (itself, since it's self-signed) as separate
+// PEM files under dir, returning their paths.
+func (s S) writeTestCertFiles(c *check.C, dir string) (certFile, keyFile, caFile string) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, check.IsNil)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "bs-test"},
+		NotBefore:    time.Unix(0, 0),
+		NotAfter:     time.Unix(0, 0).Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	c.Assert(err, check.IsNil)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	caFile = filepath.Join(dir, "ca.pem")
+	c.Assert(ioutil.WriteFile(certFile, certPEM, os.FileMode(0600)), check.IsNil)
+	c.Assert(ioutil.WriteFile(keyFile, keyPEM, os.FileMode(0600)), check.IsNil)
+	c.Assert(ioutil.WriteFile(caFile, certPEM, os.FileMode(0600)), check.IsNil)
+	return certFile, keyFile, caFile
+}
+
+func (s S) startDockerServer(c *check.C) (*dtesting.DockerServer, *docker.Client) {
+	server, err := dtesting.NewServer("127.0.0.1:0", nil, nil)
+	c.Assert(err, check.IsNil)
+	client, err := docker.NewClient(server.URL())
+	c.Assert(err, check.IsNil)
+	return server, client
+}
+
+func (s S) createContainer(c *check.C, client *docker.Client, env []string) *docker.Container {
+	err := client.PullImage(docker.PullImageOptions{Repository: "tsuru/python"}, docker.AuthConfiguration{})
+	c.Assert(err, check.IsNil)
+	cont, err := client.CreateContainer(docker.CreateContainerOptions{
+		Config: &docker.Config{Image: "tsuru/python", Env: env},
+	})
+	c.Assert(err, check.IsNil)
+	return cont
+}
+
+func (s S) TestConsumeDockerEventsStartPopulatesCache(c *check.C) {
+	server, client := s.startDockerServer(c)
+	defer server.Stop()
+	cont := s.createContainer(c, client, []string{"TSURU_APPNAME=myapp", "TSURU_PROCESSNAME=web"})
+	l := s.forwarder()
+	l.dockerClient = client
+	l.stopEvents = make(chan struct{})
+	var err error
+	l.containerDataCache, err = lru.New(10)
+	c.Assert(err, check.IsNil)
+	listener := make(chan *docker.APIEvents, 1)
+	listener <- &docker.APIEvents{Status: "start", ID: cont.ID}
+	close(listener)
+	l.consumeDockerEvents(listener)
+	val, ok := l.containerDataCache.Get(cont.ID)
+	c.Assert(ok, check.Equals, true)
+	data := val.(*containerData)
+	c.Assert(data.appName, check.Equals, "myapp")
+	c.Assert(data.processName, check.Equals, "web")
+}
+
+func (s S) TestConsumeDockerEventsDieEvictsCache(c *check.C) {
+	l := s.forwarder()
+	l.stopEvents = make(chan struct{})
+	var err error
+	l.containerDataCache, err = lru.New(10)
+	c.Assert(err, check.IsNil)
+	l.containerDataCache.Add("cont-1", &containerData{appName: "myapp", processName: "web"})
+	listener := make(chan *docker.APIEvents, 1)
+	listener <- &docker.APIEvents{Status: "die", ID: "cont-1"}
+	close(listener)
+	l.consumeDockerEvents(listener)
+	_, ok := l.containerDataCache.Get("cont-1")
+	c.Assert(ok, check.Equals, false)
+}
+
+func (s S) TestConsumeDockerEventsDestroyEvictsCache(c *check.C) {
+	l := s.forwarder()
+	l.stopEvents = make(chan struct{})
+	var err error
+	l.containerDataCache, err = lru.New(10)
+	c.Assert(err, check.IsNil)
+	l.containerDataCache.Add("cont-1", &containerData{appName: "myapp", processName: "web"})
+	listener := make(chan *docker.APIEvents, 1)
+	listener <- &docker.APIEvents{Status: "destroy", ID: "cont-1"}
+	close(listener)
+	l.consumeDockerEvents(listener)
+	_, ok := l.containerDataCache.Get("cont-1")
+	c.Assert(ok, check.Equals, false)
+}
+
+func (s S) TestConsumeDockerEventsStopsOnStopEvents(c *check.C) {
+	l := s.forwarder()
+	l.stopEvents = make(chan struct{})
+	var err error
+	l.containerDataCache, err = lru.New(10)
+	c.Assert(err, check.IsNil)
+	listener := make(chan *docker.APIEvents)
+	close(l.stopEvents)
+	l.consumeDockerEvents(listener)
+}
+
+// TestHandleDropsWhenForwardQueueIsFull asserts Handle never blocks on a
+// full forward queue: it must drop the message through the non-blocking
+// select/default in the common case of a stalled forward destination.
+func (s S) TestHandleDropsWhenForwardQueueIsFull(c *check.C) {
+	l := s.forwarder()
+	var err error
+	l.containerDataCache, err = lru.New(10)
+	c.Assert(err, check.IsNil)
+	l.containerDataCache.Add("cont-1", &containerData{appName: "myapp", processName: "web"})
+	fc := &forwardConn{addr: "tcp://forward.example.com:514", queue: make(chan []byte, 1)}
+	fc.queue <- []byte("already queued\n")
+	l.forwardConns = []*forwardConn{fc}
+	logParts := syslogparser.LogParts{
+		"container_id": "cont-1",
+		"timestamp":    time.Now(),
+		"priority":     1,
+		"content":      "hello",
+	}
+	done := make(chan struct{})
+	go func() {
+		l.Handle(logParts, 0, nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		c.Fatal("Handle blocked instead of dropping the message")
+	}
+	c.Assert(atomic.LoadInt64(&fc.dropped), check.Equals, int64(1))
+	c.Assert(fc.queue, check.HasLen, 1)
+}
+
+// blockingConn is a net.Conn whose Write never returns until Close is
+// called, simulating a forward destination that has stopped reading.
+type blockingConn struct {
+	net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newBlockingConn() *blockingConn {
+	return &blockingConn{closed: make(chan struct{})}
+}
+
+func (b *blockingConn) Write(p []byte) (int, error) {
+	<-b.closed
+	return 0, errors.New("connection closed")
+}
+
+func (b *blockingConn) Close() error {
+	b.closeOnce.Do(func() { close(b.closed) })
+	return nil
+}
+
+func (s S) TestShutdownIsIdempotent(c *check.C) {
+	l := s.forwarder()
+	l.server = syslog.NewServer()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	c.Assert(l.Shutdown(ctx), check.IsNil)
+	c.Assert(l.Shutdown(ctx), check.IsNil)
+}
+
+// TestShutdownReturnsCtxErrWhenWriterIsStuck asserts that a forward writer
+// blocked on a dead connection does not prevent Shutdown from honoring ctx's
+// deadline: it must return ctx.Err() instead of hanging until the stuck
+// write eventually unblocks.
+func (s S) TestShutdownReturnsCtxErrWhenWriterIsStuck(c *check.C) {
+	l := s.forwarder()
+	l.server = syslog.NewServer()
+	fc := &forwardConn{addr: "tcp://forward.example.com:514", queue: make(chan []byte, 1), done: make(chan struct{})}
+	fc.setConn(newBlockingConn())
+	fc.queue <- []byte("stuck write\n")
+	l.forwardConns = []*forwardConn{fc}
+	l.writersWG.Add(1)
+	go l.runForwardWriter(fc)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := l.Shutdown(ctx)
+	c.Assert(err, check.Equals, context.DeadlineExceeded)
+	c.Assert(time.Since(start) < time.Second, check.Equals, true)
+}
+
+// withDockerEnv sets the given docker env vars for the duration of fn,
+// restoring whatever was there before (including unsetting vars that
+// weren't previously set) once fn returns.
+func (s S) withDockerEnv(c *check.C, env map[string]string, fn func()) {
+	prev := map[string]string{}
+	hadPrev := map[string]bool{}
+	for k := range env {
+		prev[k], hadPrev[k] = os.LookupEnv(k)
+	}
+	defer func() {
+		for k := range env {
+			if hadPrev[k] {
+				os.Setenv(k, prev[k])
+			} else {
+				os.Unsetenv(k)
+			}
+		}
+	}()
+	for k, v := range env {
+		c.Assert(os.Setenv(k, v), check.IsNil)
+	}
+	fn()
+}
+
+func (s S) TestApplyDockerEnvDefaultsHostOnly(c *check.C) {
+	s.withDockerEnv(c, map[string]string{
+		"DOCKER_HOST":       "tcp://127.0.0.1:2376",
+		"DOCKER_CERT_PATH":  "",
+		"DOCKER_TLS_VERIFY": "",
+	}, func() {
+		l := &LogForwarder{}
+		l.applyDockerEnvDefaults()
+		c.Assert(l.DockerEndpoint, check.Equals, "tcp://127.0.0.1:2376")
+		c.Assert(l.DockerTLSCert, check.Equals, "")
+		c.Assert(l.DockerTLSKey, check.Equals, "")
+		c.Assert(l.DockerTLSCA, check.Equals, "")
+	})
+}
+
+func (s S) TestApplyDockerEnvDefaultsCertPathWithoutTLSVerify(c *check.C) {
+	s.withDockerEnv(c, map[string]string{
+		"DOCKER_HOST":       "tcp://127.0.0.1:2376",
+		"DOCKER_CERT_PATH":  "/certs",
+		"DOCKER_TLS_VERIFY": "",
+	}, func() {
+		l := &LogForwarder{}
+		l.applyDockerEnvDefaults()
+		c.Assert(l.DockerTLSCert, check.Equals, "")
+		c.Assert(l.DockerTLSKey, check.Equals, "")
+		c.Assert(l.DockerTLSCA, check.Equals, "")
+	})
+}
+
+func (s S) TestApplyDockerEnvDefaultsCertPathWithTLSVerify(c *check.C) {
+	s.withDockerEnv(c, map[string]string{
+		"DOCKER_HOST":       "tcp://127.0.0.1:2376",
+		"DOCKER_CERT_PATH":  "/certs",
+		"DOCKER_TLS_VERIFY": "1",
+	}, func() {
+		l := &LogForwarder{}
+		l.applyDockerEnvDefaults()
+		c.Assert(l.DockerTLSCert, check.Equals, filepath.Join("/certs", "cert.pem"))
+		c.Assert(l.DockerTLSKey, check.Equals, filepath.Join("/certs", "key.pem"))
+		c.Assert(l.DockerTLSCA, check.Equals, filepath.Join("/certs", "ca.pem"))
+	})
+}
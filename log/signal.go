@@ -0,0 +1,62 @@
+package log
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// StatusReporter is the subset of status.Reporter the signal trap needs to
+// coordinate with: Stop halts scheduling further reports and Wait blocks
+// until any report already in flight (e.g. a POST to /units/status)
+// completes, mirroring the Kill/Wait pattern used by the syslog server.
+type StatusReporter interface {
+	Stop()
+	Wait()
+}
+
+// WaitForSignals traps SIGINT/SIGTERM/SIGQUIT and drives a graceful
+// shutdown of l and, if given, reporter. The first signal starts a graceful
+// shutdown: it first waits, with no deadline, for reporter to stop, then
+// shuts l down bounded by shutdownTimeout. The second signal is just logged
+// and the third forces an immediate exit. SIGQUIT exits immediately without
+// shutdown when DEBUG is set, matching docker-engine-style daemons. It
+// blocks until the process should exit.
+func WaitForSignals(l *LogForwarder, reporter StatusReporter, shutdownTimeout time.Duration) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	received := 0
+	for sig := range sigCh {
+		if sig == syscall.SIGQUIT && os.Getenv("DEBUG") != "" {
+			log.Printf("[log forwarder] received %s with DEBUG set, exiting immediately", sig)
+			os.Exit(1)
+		}
+		received++
+		switch received {
+		case 1:
+			log.Printf("[log forwarder] received %s, shutting down gracefully", sig)
+			go gracefulExit(l, reporter, shutdownTimeout)
+		case 2:
+			log.Printf("[log forwarder] received %s again, still shutting down, one more forces exit", sig)
+		default:
+			log.Printf("[log forwarder] received %s a third time, forcing exit", sig)
+			os.Exit(1)
+		}
+	}
+}
+
+func gracefulExit(l *LogForwarder, reporter StatusReporter, shutdownTimeout time.Duration) {
+	if reporter != nil {
+		reporter.Stop()
+		reporter.Wait()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := l.Shutdown(ctx); err != nil {
+		log.Printf("[log forwarder] error during graceful shutdown: %s", err)
+	}
+	os.Exit(0)
+}